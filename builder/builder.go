@@ -0,0 +1,289 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package builder turns an OCI/Docker image into a bootable Capstan disk
+// image, so that `capstan build` can produce a VM from an ordinary
+// container image instead of requiring a pre-existing OSv/unikernel
+// artifact. Like the rest of Capstan's hypervisor backends, it drives
+// well-known external tools (skopeo, losetup, mkfs, grub-install) rather
+// than vendoring an image-handling library.
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type Bootloader string
+
+const (
+	GRUB    Bootloader = "grub"
+	GRUBEFI Bootloader = "grub-efi"
+)
+
+type Format string
+
+const (
+	Raw   Format = "raw"
+	Qcow2 Format = "qcow2"
+	VDI   Format = "vdi"
+	VMDK  Format = "vmdk"
+	VHD   Format = "vhd"
+)
+
+type Config struct {
+	From       string
+	Bootloader Bootloader
+	Format     Format
+}
+
+// DefaultConfig fills in the flags accepted by `capstan build --from`.
+func DefaultConfig(from string) *Config {
+	return &Config{
+		From:       from,
+		Bootloader: GRUB,
+		Format:     Qcow2,
+	}
+}
+
+// BuildImage pulls c.From, flattens it into a bootable rootfs, and
+// returns the path of the finished disk image, disk.<format> in a new
+// temporary directory. The image is not added to a repository and name
+// is not used. It is invoked from the `build` CLI command whenever
+// --from is given, as an alternative to qemu.BuildImage's unikernel
+// image path.
+func BuildImage(name string, c *Config) (string, error) {
+	work, err := ioutil.TempDir("", "capstan-build-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+
+	rootfs := filepath.Join(work, "rootfs")
+	if err := pullAndFlatten(c.From, rootfs); err != nil {
+		return "", err
+	}
+
+	disk := filepath.Join(work, "disk.raw")
+	if err := createDisk(disk, rootfs, c.Bootloader); err != nil {
+		return "", err
+	}
+
+	outDir, err := ioutil.TempDir("", "capstan-image-")
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(outDir, fmt.Sprintf("disk.%s", c.Format))
+	if c.Format != Raw {
+		if err := convertDisk(disk, out, c.Format); err != nil {
+			return "", err
+		}
+	} else if err := os.Rename(disk, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// pullAndFlatten pulls imageRef with skopeo/umoci and extracts its
+// layers, last-one-wins, into dest so dest becomes a plain rootfs tree.
+func pullAndFlatten(imageRef string, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	bundle := dest + ".bundle"
+	if err := run("skopeo", "copy", "docker://"+imageRef, "oci:"+bundle+":latest"); err != nil {
+		return fmt.Errorf("builder: pulling %s: %s", imageRef, err)
+	}
+	if err := run("umoci", "unpack", "--image", bundle, dest+".unpacked"); err != nil {
+		return fmt.Errorf("builder: unpacking %s: %s", imageRef, err)
+	}
+	return run("cp", "-a", filepath.Join(dest+".unpacked", "rootfs")+"/.", dest)
+}
+
+// createDisk lays out a partitioned raw disk for rootfs: an MBR/GPT
+// table, an ext4 root partition (and a FAT32 /boot for grub-efi), both
+// actually formatted and loopback-mounted so rootfs's contents, fstab,
+// the kernel cmdline, GRUB itself and a grub.cfg pointing at the kernel
+// land on the disk image rather than on the host tmp directory rootfs
+// lives in.
+func createDisk(disk string, rootfs string, bootloader Bootloader) error {
+	if err := run("qemu-img", "create", "-f", "raw", disk, "1G"); err != nil {
+		return err
+	}
+
+	partTable := "msdos"
+	if bootloader == GRUBEFI {
+		partTable = "gpt"
+	}
+	if err := run("parted", "-s", disk, "mklabel", partTable); err != nil {
+		return err
+	}
+
+	rootPart, bootPart := 1, 0
+	if bootloader == GRUBEFI {
+		if err := run("parted", "-s", disk, "mkpart", "ESP", "fat32", "1MiB", "257MiB"); err != nil {
+			return err
+		}
+		if err := run("parted", "-s", disk, "set", "1", "boot", "on"); err != nil {
+			return err
+		}
+		if err := run("parted", "-s", disk, "mkpart", "primary", "ext4", "257MiB", "100%"); err != nil {
+			return err
+		}
+		bootPart, rootPart = 1, 2
+	} else {
+		if err := run("parted", "-s", disk, "mkpart", "primary", "ext4", "1MiB", "100%"); err != nil {
+			return err
+		}
+		if err := run("parted", "-s", disk, "set", "1", "boot", "on"); err != nil {
+			return err
+		}
+	}
+
+	loopDev, err := attachLoop(disk)
+	if err != nil {
+		return err
+	}
+	defer run("losetup", "-d", loopDev)
+
+	if err := run("mkfs.ext4", "-F", partitionDev(loopDev, rootPart)); err != nil {
+		return err
+	}
+	if bootPart != 0 {
+		if err := run("mkfs.vfat", "-F", "32", partitionDev(loopDev, bootPart)); err != nil {
+			return err
+		}
+	}
+
+	mnt, err := ioutil.TempDir("", "capstan-mnt-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(mnt)
+	if err := run("mount", partitionDev(loopDev, rootPart), mnt); err != nil {
+		return err
+	}
+	defer run("umount", mnt)
+
+	if err := run("cp", "-a", rootfs+"/.", mnt); err != nil {
+		return err
+	}
+
+	if bootPart != 0 {
+		bootMnt := filepath.Join(mnt, "boot")
+		if err := os.MkdirAll(bootMnt, 0755); err != nil {
+			return err
+		}
+		if err := run("mount", partitionDev(loopDev, bootPart), bootMnt); err != nil {
+			return err
+		}
+		defer run("umount", bootMnt)
+	}
+
+	if err := writeFstabAndCmdline(mnt); err != nil {
+		return err
+	}
+
+	target := "i386-pc"
+	if bootloader == GRUBEFI {
+		target = "x86_64-efi"
+	}
+	if err := run("grub-install", "--target="+target, "--boot-directory="+filepath.Join(mnt, "boot"), "--root-directory="+mnt, loopDev); err != nil {
+		return err
+	}
+	return writeGrubCfg(mnt)
+}
+
+// attachLoop associates disk with a free loop device and asks the
+// kernel to scan it for partitions (-P), so partitionDev's /dev/loopNpM
+// nodes show up for mkfs/mount to use.
+func attachLoop(disk string) (string, error) {
+	cmd := exec.Command("losetup", "-fP", "--show", disk)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("builder: losetup %s: %s", disk, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func partitionDev(loopDev string, part int) string {
+	return fmt.Sprintf("%sp%d", loopDev, part)
+}
+
+// writeFstabAndCmdline writes /etc/fstab and /boot/cmdline.txt directly
+// onto the mounted root partition at mnt, so they end up on the disk
+// image rather than in a host-side scratch directory.
+func writeFstabAndCmdline(mnt string) error {
+	fstab := "/dev/sda1  /  ext4  errors=remount-ro  0  1\n"
+	if err := ioutil.WriteFile(filepath.Join(mnt, "etc", "fstab"), []byte(fstab), 0644); err != nil {
+		return err
+	}
+	cmdline := "root=/dev/sda1 console=ttyS0 console=tty0\n"
+	return ioutil.WriteFile(filepath.Join(mnt, "boot", "cmdline.txt"), []byte(cmdline), 0644)
+}
+
+// writeGrubCfg renders a minimal grub.cfg pointing at whatever kernel
+// (and initrd, if any) pullAndFlatten's rootfs shipped under /boot.
+// grub-install only lays down GRUB's own core image and modules; without
+// this, GRUB has no menuentry to boot and drops to a rescue prompt.
+func writeGrubCfg(mnt string) error {
+	kernel, err := findBootFile(mnt, "vmlinuz*")
+	if err != nil {
+		return err
+	}
+
+	cfg := "set timeout=0\nset default=0\n\n"
+	cfg += "menuentry \"capstan\" {\n"
+	cfg += fmt.Sprintf("\tlinux %s root=/dev/sda1 console=ttyS0 console=tty0\n", kernel)
+	if initrd, err := findBootFile(mnt, "initrd.img*"); err == nil {
+		cfg += fmt.Sprintf("\tinitrd %s\n", initrd)
+	}
+	cfg += "}\n"
+
+	grubDir := filepath.Join(mnt, "boot", "grub")
+	if err := os.MkdirAll(grubDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(cfg), 0644)
+}
+
+// findBootFile globs pattern under mnt/boot and returns the match as a
+// path GRUB can load at boot, i.e. relative to /boot rather than to mnt.
+func findBootFile(mnt string, pattern string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(mnt, "boot", pattern))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("builder: no /boot/%s found in rootfs", pattern)
+	}
+	return filepath.Join("/boot", filepath.Base(matches[0])), nil
+}
+
+// convertDisk re-encodes the raw disk into format using qemu-img, which
+// is already a build-time dependency of the qemu backend. qemu-img
+// names the VHD format "vpc".
+func convertDisk(raw string, out string, format Format) error {
+	qemuFormat := string(format)
+	if format == VHD {
+		qemuFormat = "vpc"
+	}
+	return run("qemu-img", "convert", "-f", "raw", "-O", qemuFormat, raw, out)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %s: %s", name, args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitionDev(t *testing.T) {
+	if got, want := partitionDev("/dev/loop0", 1), "/dev/loop0p1"; got != want {
+		t.Fatalf("partitionDev() = %s, want %s", got, want)
+	}
+	if got, want := partitionDev("/dev/loop0", 2), "/dev/loop0p2"; got != want {
+		t.Fatalf("partitionDev() = %s, want %s", got, want)
+	}
+}
+
+func TestFindBootFile(t *testing.T) {
+	mnt, err := ioutil.TempDir("", "capstan-builder-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mnt)
+
+	boot := filepath.Join(mnt, "boot")
+	if err := os.MkdirAll(boot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(boot, "vmlinuz-5.10.0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := findBootFile(mnt, "vmlinuz*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/boot/vmlinuz-5.10.0"; got != want {
+		t.Fatalf("findBootFile() = %s, want %s", got, want)
+	}
+
+	if _, err := findBootFile(mnt, "initrd.img*"); err == nil {
+		t.Fatal("findBootFile succeeded for a pattern with no match")
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package capstan is the Capstan image repository: it stores named VM
+// images locally and tracks the platform (linux/amd64, linux/arm64,
+// ...) each one was built for, so that a single named image can have
+// one variant per architecture and the right one is picked automatically.
+package capstan
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudius-systems/capstan/hypervisor/vbox"
+	"github.com/cloudius-systems/capstan/nat"
+	"github.com/cloudius-systems/capstan/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Repo is a local image repository rooted at Path. Platform is the
+// target platform used by PushImage/PullImage/ImagePath when the
+// caller doesn't ask for a specific one, and defaults to the host's.
+type Repo struct {
+	Path     string
+	Platform string
+}
+
+func NewRepo() *Repo {
+	return &Repo{
+		Path:     filepath.Join(util.HomePath(), ".capstan", "repository"),
+		Platform: defaultPlatform(),
+	}
+}
+
+func defaultPlatform() string {
+	if runtime.GOARCH == "arm64" {
+		return "linux/arm64"
+	}
+	return "linux/amd64"
+}
+
+type imageMeta struct {
+	Platform string `json:"platform"`
+}
+
+func platformSlug(platform string) string {
+	return strings.Replace(platform, "/", "-", -1)
+}
+
+func (r *Repo) imageDir(name string) string {
+	return filepath.Join(r.Path, name)
+}
+
+func (r *Repo) variantPath(name, platform string) string {
+	return filepath.Join(r.imageDir(name), platformSlug(platform))
+}
+
+func (r *Repo) metaPath(name, platform string) string {
+	return r.variantPath(name, platform) + ".json"
+}
+
+// PushImage records file into the repository under name, tagged with
+// r.Platform, so a later PullImage/ImagePath for the same platform
+// finds it again.
+func (r *Repo) PushImage(name, file string) error {
+	if err := os.MkdirAll(r.imageDir(name), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(file, r.variantPath(name, r.Platform)); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(imageMeta{Platform: r.Platform})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.metaPath(name, r.Platform), meta, 0644)
+}
+
+// PullImage makes sure name's r.Platform variant is present locally,
+// returning an error naming the missing platform otherwise. Capstan has
+// no remote index in this repository yet, so "pulling" only checks
+// what's already been pushed.
+func (r *Repo) PullImage(name string) error {
+	_, err := r.ImagePath(name)
+	return err
+}
+
+// RemoveImage deletes every platform variant of name from the repository.
+func (r *Repo) RemoveImage(name string) {
+	os.RemoveAll(r.imageDir(name))
+}
+
+// ListImages prints each image name together with the platform(s) it
+// has a variant for.
+func (r *Repo) ListImages() {
+	entries, err := ioutil.ReadDir(r.Path)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		variants, err := ioutil.ReadDir(filepath.Join(r.Path, entry.Name()))
+		if err != nil {
+			continue
+		}
+		for _, v := range variants {
+			if filepath.Ext(v.Name()) != ".json" {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(r.Path, entry.Name(), v.Name()))
+			if err != nil {
+				continue
+			}
+			var meta imageMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				continue
+			}
+			fmt.Printf("%s\t%s\n", entry.Name(), meta.Platform)
+		}
+	}
+}
+
+// ImagePath returns the on-disk path of name's r.Platform variant.
+func (r *Repo) ImagePath(name string) (string, error) {
+	path := r.variantPath(name, r.Platform)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("capstan: no image %q for platform %s in repository", name, r.Platform)
+	}
+	return path, nil
+}
+
+// VMConfig builds a vbox.VMConfig for name's r.Platform variant, with
+// Capstan's usual defaults for memory and CPU count, and a NAT rule
+// forwarding a free host port to the guest's port 22 so that
+// `capstan machine ssh` has something to dial.
+func (r *Repo) VMConfig(name string) *vbox.VMConfig {
+	image, _ := r.ImagePath(name)
+	return &vbox.VMConfig{
+		Name:     name,
+		Dir:      filepath.Join(util.HomePath(), ".capstan", "instances", "vbox"),
+		Image:    image,
+		Platform: r.Platform,
+		Memory:   512,
+		Cpus:     2,
+		NatRules: sshNatRules(),
+	}
+}
+
+// sshNatRules returns a single NAT rule forwarding a free host port to
+// the guest's port 22, or no rules at all if a free port can't be found,
+// matching VMConfig's habit of degrading rather than failing outright on
+// this kind of best-effort setup.
+func sshNatRules() []nat.Rule {
+	port, err := util.FreePort()
+	if err != nil {
+		return nil
+	}
+	return []nat.Rule{{GuestPort: "22", HostPort: port}}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -8,14 +8,159 @@
 package main
 
 import "github.com/cloudius-systems/capstan"
+import "github.com/cloudius-systems/capstan/builder"
+import "github.com/cloudius-systems/capstan/hypervisor/vbox"
+import "github.com/cloudius-systems/capstan/hypervisor/xhyve"
+import "github.com/cloudius-systems/capstan/image/convert"
+import "github.com/cloudius-systems/capstan/machine"
 import "github.com/cloudius-systems/capstan/qemu"
 import "github.com/codegangsta/cli"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
 import "os"
+import "os/exec"
+import "path/filepath"
+import "runtime"
+import "strings"
 
 var (
 	VERSION string
 )
 
+// launchVM dispatches to the hypervisor backend named by hypervisor, or
+// picks the best default for the host OS when it is empty: xhyve on
+// macOS (no KEXT or extra installs required), vbox on Windows, and qemu
+// everywhere else.
+func launchVM(repo *capstan.Repo, hypervisor string, platform string, userData string, image string) *exec.Cmd {
+	if hypervisor == "" {
+		hypervisor = defaultHypervisor()
+	}
+	if platform != "" {
+		repo.Platform = platform
+	}
+	switch hypervisor {
+	case "xhyve":
+		return xhyve.LaunchVM(repo, image)
+	case "vbox":
+		c := repo.VMConfig(image)
+		c.UserData = userData
+		cmd, err := vbox.LaunchVM(c)
+		if err != nil {
+			println(err.Error())
+			return nil
+		}
+		return cmd
+	case "qemu":
+		return qemu.LaunchVM(repo, image, platform, userData)
+	default:
+		println("unknown hypervisor: " + hypervisor)
+		return nil
+	}
+}
+
+// machineCommands builds the `capstan machine` subcommand tree: ls,
+// inspect, stop, rm and ssh, mirroring the lifecycle commands of tools
+// like `podman machine` but backed by the registry in the machine
+// package instead of a container runtime.
+func machineCommands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "ls",
+			Usage: "list running VMs",
+			Action: func(c *cli.Context) {
+				machines, err := machine.List()
+				if err != nil {
+					println(err.Error())
+					return
+				}
+				for _, m := range machines {
+					println(fmt.Sprintf("%s\t%s\t%d", m.Name, m.Hypervisor, m.PID))
+				}
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "show a VM's registry entry as JSON",
+			Action: func(c *cli.Context) {
+				m, err := machine.Load(c.Args().First())
+				if err != nil {
+					println(err.Error())
+					return
+				}
+				data, _ := json.MarshalIndent(m, "", "  ")
+				println(string(data))
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "power off a VM",
+			Action: func(c *cli.Context) {
+				name := c.Args().First()
+				m, err := machine.Load(name)
+				if err != nil {
+					println(err.Error())
+					return
+				}
+				if err := stopMachine(m); err != nil {
+					println(err.Error())
+					return
+				}
+				machine.Remove(name)
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove a VM's registry entry",
+			Action: func(c *cli.Context) {
+				if err := machine.Remove(c.Args().First()); err != nil {
+					println(err.Error())
+				}
+			},
+		},
+		{
+			Name:  "ssh",
+			Usage: "ssh into a VM over its NAT-forwarded port 22",
+			Action: func(c *cli.Context) {
+				m, err := machine.Load(c.Args().First())
+				if err != nil {
+					println(err.Error())
+					return
+				}
+				if err := m.SSH(); err != nil {
+					println(err.Error())
+				}
+			},
+		},
+	}
+}
+
+func stopMachine(m *machine.Machine) error {
+	switch m.Hypervisor {
+	case "vbox":
+		return vbox.StopVM(m.Name)
+	case "xhyve":
+		proc, err := os.FindProcess(m.PID)
+		if err != nil {
+			return err
+		}
+		return proc.Kill()
+	default:
+		return qemu.StopVM(m.Name)
+	}
+}
+
+func defaultHypervisor() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "xhyve"
+	case "windows":
+		return "vbox"
+	default:
+		return "qemu"
+	}
+}
+
 func main() {
 	repo := capstan.NewRepo()
 	app := cli.NewApp()
@@ -57,16 +202,57 @@ func main() {
 		{
 			Name:  "run",
 			Usage: "launch a VM",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "hypervisor", Value: "", Usage: "hypervisor to run with: qemu, vbox or xhyve (default: best match for this OS)"},
+				cli.StringFlag{Name: "platform", Value: "", Usage: "target platform: linux/amd64 or linux/arm64 (default: host platform)"},
+				cli.StringFlag{Name: "user-data", Value: "", Usage: "path to an Ignition config or cloud-init user-data file to seed on first boot"},
+			},
 			Action: func(c *cli.Context) {
-				cmd := qemu.LaunchVM(repo, c.Args().First())
-				cmd.Wait()
+				name := c.Args().First()
+				userData := ""
+				if path := c.String("user-data"); path != "" {
+					data, err := ioutil.ReadFile(path)
+					if err != nil {
+						println(err.Error())
+						return
+					}
+					userData = string(data)
+				}
+				cmd := launchVM(repo, c.String("hypervisor"), c.String("platform"), userData, name)
+				if cmd != nil {
+					cmd.Wait()
+					machine.Remove(name)
+				}
 			},
 		},
+		{
+			Name:        "machine",
+			Usage:       "manage running VMs",
+			Subcommands: machineCommands(),
+		},
 		{
 			Name:  "build",
 			Usage: "build an image",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "from", Value: "", Usage: "build from a Docker/OCI image reference instead of a unikernel artifact"},
+				cli.StringFlag{Name: "bootloader", Value: "grub", Usage: "bootloader to install: grub or grub-efi"},
+				cli.StringFlag{Name: "format", Value: "qcow2", Usage: "output disk format: raw, qcow2, vdi, vmdk or vhd"},
+				cli.StringFlag{Name: "platform", Value: "", Usage: "target platform: linux/amd64 or linux/arm64 (default: host platform)"},
+			},
 			Action: func(c *cli.Context) {
-				qemu.BuildImage(repo, c.Args().First())
+				if from := c.String("from"); from != "" {
+					cfg := builder.DefaultConfig(from)
+					cfg.Bootloader = builder.Bootloader(c.String("bootloader"))
+					cfg.Format = builder.Format(c.String("format"))
+					disk, err := builder.BuildImage(c.Args().First(), cfg)
+					if err != nil {
+						println(err.Error())
+						return
+					}
+					println("built " + disk)
+					return
+				}
+				qemu.BuildImage(repo, c.Args().First(), c.String("platform"))
 			},
 		},
 		{
@@ -76,6 +262,33 @@ func main() {
 				repo.ListImages()
 			},
 		},
+		{
+			Name:  "convert",
+			Usage: "convert an image to a different disk format",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "", Usage: "target format: qcow2, vmdk, vhd, raw or vdi"},
+			},
+			Action: func(c *cli.Context) {
+				image := c.Args().First()
+				to := convert.Format(c.String("format"))
+				if to == "" {
+					println("usage: capstan convert [image] --format {qcow2,vmdk,vhd,raw,vdi}")
+					return
+				}
+				path, err := repo.ImagePath(image)
+				if err != nil {
+					println(err.Error())
+					return
+				}
+				from := convert.Format(strings.TrimPrefix(filepath.Ext(path), "."))
+				dst := strings.TrimSuffix(path, filepath.Ext(path)) + "." + string(to)
+				if err := convert.Convert(path, dst, from, to); err != nil {
+					println(err.Error())
+					return
+				}
+				println("converted " + dst)
+			},
+		},
 	}
 	app.Run(os.Args)
-}
\ No newline at end of file
+}
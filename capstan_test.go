@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package capstan
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRepo(t *testing.T, platform string) (*Repo, func()) {
+	dir, err := ioutil.TempDir("", "capstan-repo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Repo{Path: dir, Platform: platform}, func() { os.RemoveAll(dir) }
+}
+
+func TestPushPullImagePerPlatform(t *testing.T) {
+	r, cleanup := newTestRepo(t, "linux/amd64")
+	defer cleanup()
+
+	src := filepath.Join(r.Path, "image.raw")
+	if err := ioutil.WriteFile(src, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PushImage("app", src); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.PullImage("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Platform = "linux/arm64"
+	if err := r.PullImage("app"); err == nil {
+		t.Fatal("PullImage succeeded for a platform that was never pushed")
+	}
+}
+
+func TestPushImageKeepsEveryPlatformVariant(t *testing.T) {
+	r, cleanup := newTestRepo(t, "linux/amd64")
+	defer cleanup()
+
+	src := filepath.Join(r.Path, "image.raw")
+	if err := ioutil.WriteFile(src, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PushImage("app", src); err != nil {
+		t.Fatal(err)
+	}
+	r.Platform = "linux/arm64"
+	if err := r.PushImage("app", src); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(r.Path, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := 0
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".json" {
+			variants++
+		}
+	}
+	if variants != 2 {
+		t.Fatalf("got %d platform variants, want 2", variants)
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	r, cleanup := newTestRepo(t, "linux/amd64")
+	defer cleanup()
+
+	src := filepath.Join(r.Path, "image.raw")
+	if err := ioutil.WriteFile(src, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PushImage("app", src); err != nil {
+		t.Fatal(err)
+	}
+
+	r.RemoveImage("app")
+	if err := r.PullImage("app"); err == nil {
+		t.Fatal("PullImage succeeded after RemoveImage")
+	}
+}
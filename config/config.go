@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package config builds first-boot configuration for a Capstan VM from
+// a cloud-init or Ignition user-data file, passed via `capstan run
+// --user-data`. It renders a seed ISO that hypervisor backends attach as
+// a second disk: a NoCloud cidata ISO for cloud-init, or an OpenStack
+// config-drive ISO for Ignition, since the config-drive provider is the
+// one Ignition datasource reachable through a plain attached disk (no
+// fw_cfg channel is available through vbox/xhyve to pass a config
+// directly).
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+type ignition struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+}
+
+// IsIgnition reports whether data looks like an Ignition config, i.e.
+// valid JSON carrying a non-empty "ignition.version" field, as opposed
+// to a cloud-init user-data YAML document.
+func IsIgnition(data []byte) bool {
+	var ign ignition
+	if err := json.Unmarshal(data, &ign); err != nil {
+		return false
+	}
+	return ign.Ignition.Version != ""
+}
+
+// BuildSeed renders userData into a first-boot configuration seed ISO
+// under dir and returns its path.
+func BuildSeed(dir string, hostname string, userData []byte) (string, error) {
+	if len(userData) == 0 {
+		return "", fmt.Errorf("config: empty user-data")
+	}
+	if IsIgnition(userData) {
+		return buildIgnitionSeed(dir, userData)
+	}
+	return buildCloudInitSeed(dir, hostname, userData)
+}
+
+// buildCloudInitSeed renders userData as a NoCloud cidata seed ISO
+// (meta-data + user-data), the datasource cloud-init checks before
+// falling back to a network lookup.
+func buildCloudInitSeed(dir string, hostname string, userData []byte) (string, error) {
+	seed := filepath.Join(dir, "seed")
+	if err := os.MkdirAll(seed, 0755); err != nil {
+		return "", err
+	}
+
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", hostname, hostname)
+	if err := ioutil.WriteFile(filepath.Join(seed, "meta-data"), []byte(metaData), 0644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(seed, "user-data"), userData, 0644); err != nil {
+		return "", err
+	}
+
+	return buildISO(dir, "cidata", filepath.Join(seed, "user-data"), filepath.Join(seed, "meta-data"))
+}
+
+// buildIgnitionSeed renders userData as an OpenStack config-drive ISO
+// (volume label "config-2", file openstack/latest/user_data), which
+// Ignition's config-drive provider reads the same way it would a real
+// OpenStack metadata service.
+func buildIgnitionSeed(dir string, userData []byte) (string, error) {
+	seed := filepath.Join(dir, "seed")
+	latest := filepath.Join(seed, "openstack", "latest")
+	if err := os.MkdirAll(latest, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(latest, "user_data"), userData, 0644); err != nil {
+		return "", err
+	}
+
+	return buildISO(dir, "config-2", seed)
+}
+
+// buildISO shells out to genisoimage to pack paths into dir/seed.iso
+// under the given volume label, the identifier a guest's datasource
+// matches on to recognize the attached disk as its config source.
+func buildISO(dir string, volid string, paths ...string) (string, error) {
+	iso := filepath.Join(dir, "seed.iso")
+	args := append([]string{"-output", iso, "-volid", volid, "-joliet", "-rock"}, paths...)
+	cmd := exec.Command("genisoimage", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("config: building seed ISO: %s: %s", err, out)
+	}
+	return iso, nil
+}
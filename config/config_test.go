@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsIgnition(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"ignition config", `{"ignition":{"version":"3.3.0"}}`, true},
+		{"cloud-init yaml", "#cloud-config\npackages:\n  - vim\n", false},
+		{"json without ignition field", `{"hello":"world"}`, false},
+		{"empty ignition version", `{"ignition":{"version":""}}`, false},
+		{"not json at all", "not json", false},
+	}
+	for _, c := range cases {
+		if got := IsIgnition([]byte(c.data)); got != c.want {
+			t.Errorf("%s: IsIgnition() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBuildSeedRejectsEmptyUserData(t *testing.T) {
+	if _, err := BuildSeed(t.TempDir(), "host", nil); err == nil {
+		t.Fatal("BuildSeed succeeded with empty user-data")
+	}
+}
+
+func TestBuildSeed(t *testing.T) {
+	if _, err := exec.LookPath("genisoimage"); err != nil {
+		t.Skip("genisoimage not on PATH")
+	}
+
+	cases := []struct {
+		name     string
+		userData string
+	}{
+		{"cloud-init", "#cloud-config\nhostname: test\n"},
+		{"ignition", `{"ignition":{"version":"3.3.0"}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "capstan-config-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			iso, err := BuildSeed(dir, "test-host", []byte(c.userData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Dir(iso) != dir {
+				t.Fatalf("seed ISO %s not under %s", iso, dir)
+			}
+			if _, err := os.Stat(iso); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
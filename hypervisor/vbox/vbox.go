@@ -9,6 +9,9 @@ package vbox
 
 import (
 	"fmt"
+	"github.com/cloudius-systems/capstan/config"
+	"github.com/cloudius-systems/capstan/image/convert"
+	"github.com/cloudius-systems/capstan/machine"
 	"github.com/cloudius-systems/capstan/nat"
 	"github.com/cloudius-systems/capstan/util"
 	"io"
@@ -27,12 +30,19 @@ type VMConfig struct {
 	Name     string
 	Dir      string
 	Image    string
+	Platform string
+	// UserData is the raw contents of an Ignition config or cloud-init
+	// user-data file to seed into the VM on first boot, or "" for none.
+	UserData string
 	Memory   int64
 	Cpus     int
 	NatRules []nat.Rule
 }
 
 func LaunchVM(c *VMConfig) (*exec.Cmd, error) {
+	if c.Platform != "" && c.Platform != "linux/amd64" {
+		return nil, fmt.Errorf("vbox: unsupported platform %s (VirtualBox only supports linux/amd64)", c.Platform)
+	}
 	exists, err := vmExists(c.Name)
 	if err != nil {
 		return nil, err
@@ -53,7 +63,7 @@ func LaunchVM(c *VMConfig) (*exec.Cmd, error) {
 	}
 
 	var conn net.Conn
-	for i:= 0; i < 5; i++ {
+	for i := 0; i < 5; i++ {
 		conn, err = util.Connect(c.sockPath())
 		if err == nil {
 			break
@@ -65,6 +75,20 @@ func LaunchVM(c *VMConfig) (*exec.Cmd, error) {
 	}
 	go io.Copy(conn, os.Stdin)
 	go io.Copy(os.Stdout, conn)
+
+	if err := machine.Save(&machine.Machine{
+		Name:       c.Name,
+		PID:        cmd.Process.Pid,
+		Hypervisor: "vbox",
+		SockPath:   c.sockPath(),
+		Image:      c.Image,
+		Memory:     c.Memory,
+		Cpus:       c.Cpus,
+		NatRules:   c.NatRules,
+	}); err != nil {
+		return nil, err
+	}
+
 	return cmd, nil
 }
 
@@ -108,7 +132,11 @@ func vmCreate(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
-	err = VBoxManage("clonehd", c.Image, c.storagePath())
+	image, err := c.vdiImage()
+	if err != nil {
+		return err
+	}
+	err = VBoxManage("clonehd", image, c.storagePath())
 	if err != nil {
 		return err
 	}
@@ -120,6 +148,16 @@ func vmCreate(c *VMConfig) error {
 	if err != nil {
 		return err
 	}
+	if c.UserData != "" {
+		seed, err := config.BuildSeed(filepath.Join(c.Dir, c.Name), c.Name, []byte(c.UserData))
+		if err != nil {
+			return err
+		}
+		err = VBoxManage("storageattach", c.Name, "--storagectl", "SATA", "--port", "1", "--type", "dvddrive", "--medium", seed)
+		if err != nil {
+			return err
+		}
+	}
 	err = VBoxManage("modifyvm", c.Name, "--nic1", "nat", "--nictype1", "virtio")
 	if err != nil {
 		return err
@@ -196,3 +234,21 @@ func (c *VMConfig) sockPath() string {
 func (c *VMConfig) storagePath() string {
 	return filepath.Join(c.Dir, c.Name, "disk.vdi")
 }
+
+// vdiImage returns a path to a VDI-format copy of c.Image, converting
+// it first via convert.Convert if it isn't already VDI so that clonehd
+// always receives a format it understands.
+func (c *VMConfig) vdiImage() (string, error) {
+	ext := strings.TrimPrefix(filepath.Ext(c.Image), ".")
+	if convert.Format(ext) == convert.VDI {
+		return c.Image, nil
+	}
+	if err := os.MkdirAll(filepath.Join(c.Dir, c.Name), 0755); err != nil {
+		return "", err
+	}
+	converted := filepath.Join(c.Dir, c.Name, "image.vdi")
+	if err := convert.Convert(c.Image, converted, convert.Format(ext), convert.VDI); err != nil {
+		return "", err
+	}
+	return converted, nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package xhyve launches Capstan images on macOS using the xhyve
+// hypervisor (libxhyve / Hypervisor.framework) so that users don't need
+// QEMU or VirtualBox installed to run a small VM image.
+package xhyve
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/cloudius-systems/capstan"
+	"github.com/cloudius-systems/capstan/machine"
+	"github.com/cloudius-systems/capstan/nat"
+	"github.com/cloudius-systems/capstan/util"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type VMConfig struct {
+	Name     string
+	Dir      string
+	Image    string
+	Memory   int64
+	Cpus     int
+	NatRules []nat.Rule
+}
+
+// LaunchVM boots imageName's repo.Platform variant from repo under
+// xhyve and, like qemu.LaunchVM, returns the started *exec.Cmd (or nil
+// after printing the error). It takes no user-data, so `run
+// --user-data` has no effect under xhyve.
+func LaunchVM(repo *capstan.Repo, imageName string) *exec.Cmd {
+	image, err := repo.ImagePath(imageName)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+	c := &VMConfig{
+		Name:     imageName,
+		Dir:      filepath.Join(util.HomePath(), ".capstan", "instances", "xhyve"),
+		Image:    image,
+		Memory:   512,
+		Cpus:     2,
+		NatRules: sshNatRules(),
+	}
+	cmd, err := vmRun(c)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+	return cmd
+}
+
+func vmRun(c *VMConfig) (*exec.Cmd, error) {
+	if err := os.MkdirAll(filepath.Join(c.Dir, c.Name), 0755); err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-A",
+		"-m", fmt.Sprintf("%dM", c.Memory),
+		"-c", fmt.Sprintf("%d", c.Cpus),
+		"-s", "0:0,hostbridge",
+		"-s", "31,lpc",
+		"-s", fmt.Sprintf("2:0,virtio-net,%s,mac=%s", "vmnet0", macFromUUID(uuidFromName(c.Name))),
+		"-s", fmt.Sprintf("4:0,virtio-blk,%s", c.Image),
+		"-l", fmt.Sprintf("com1,%s", c.sockPath()),
+		"-U", uuidFromName(c.Name),
+	}
+	if err := natSetup(c); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("xhyve", args...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 5; i++ {
+		conn, err = util.Connect(c.sockPath())
+		if err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go io.Copy(conn, os.Stdin)
+	go io.Copy(os.Stdout, conn)
+
+	if err := machine.Save(&machine.Machine{
+		Name:       c.Name,
+		PID:        cmd.Process.Pid,
+		Hypervisor: "xhyve",
+		SockPath:   c.sockPath(),
+		Image:      c.Image,
+		Memory:     c.Memory,
+		Cpus:       c.Cpus,
+		NatRules:   c.NatRules,
+	}); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// natSetup forwards the VM's NAT rules onto the xhyve vmnet interface.
+// xhyve has no built-in NAT port-forwarding of its own, so rules are
+// applied as pf(4) rdr rules against the host, the same ones vbox would
+// otherwise install via VBoxManage natpf1.
+func natSetup(c *VMConfig) error {
+	if len(c.NatRules) == 0 {
+		return nil
+	}
+	// pfctl -f replaces the anchor's whole ruleset, so every rule is
+	// loaded in a single call.
+	ruleset := ""
+	for _, rule := range c.NatRules {
+		ruleset += fmt.Sprintf(
+			"pass in on en0 proto tcp from any to any port %s rdr-to vmnet0 port %s\n",
+			rule.HostPort, rule.GuestPort,
+		)
+	}
+	cmd := exec.Command("pfctl", "-a", "capstan/"+c.Name, "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("xhyve: pfctl nat rule for %s: %s", c.Name, err)
+	}
+	return nil
+}
+
+// sshNatRules returns a single NAT rule forwarding a free host port to
+// the guest's port 22, or no rules at all if a free port can't be found,
+// so `capstan machine ssh` has a rule to dial against.
+func sshNatRules() []nat.Rule {
+	port, err := util.FreePort()
+	if err != nil {
+		return nil
+	}
+	return []nat.Rule{{GuestPort: "22", HostPort: port}}
+}
+
+// uuidFromName derives a stable UUID for a VM name so that repeated runs
+// of the same image keep the same guest identity across invocations.
+func uuidFromName(name string) string {
+	sum := md5.Sum([]byte(name))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// macFromUUID derives a locally-administered MAC address from a VM UUID,
+// since xhyve's virtio-net backend needs a stable mac= to avoid the guest
+// re-detecting its NIC as new hardware on every boot.
+func macFromUUID(uuid string) string {
+	sum := md5.Sum([]byte(uuid))
+	mac := sum[0:6]
+	mac[0] = (mac[0] & 0xfe) | 0x02
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
+
+func (c *VMConfig) sockPath() string {
+	return filepath.Join(c.Dir, c.Name, fmt.Sprintf("%s.sock", c.Name))
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package xhyve
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUUIDFromNameIsStable(t *testing.T) {
+	a := uuidFromName("my-vm")
+	b := uuidFromName("my-vm")
+	if a != b {
+		t.Fatalf("uuidFromName not stable: %s != %s", a, b)
+	}
+	if uuidFromName("other-vm") == a {
+		t.Fatal("uuidFromName collided for different names")
+	}
+}
+
+func TestMacFromUUIDIsLocallyAdministered(t *testing.T) {
+	mac := macFromUUID(uuidFromName("my-vm"))
+	var first int
+	if _, err := fmt.Sscanf(mac, "%02x", &first); err != nil {
+		t.Fatal(err)
+	}
+	if first&0x02 == 0 {
+		t.Fatalf("mac %s is not locally-administered", mac)
+	}
+	if first&0x01 != 0 {
+		t.Fatalf("mac %s is a multicast address", mac)
+	}
+}
+
+func TestMacFromUUIDIsStable(t *testing.T) {
+	uuid := uuidFromName("my-vm")
+	if macFromUUID(uuid) != macFromUUID(uuid) {
+		t.Fatal("macFromUUID not stable for the same uuid")
+	}
+}
@@ -0,0 +1,493 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package convert transforms repo images between disk formats so that
+// the same image can drive either the qemu or the vbox backend, and so
+// `capstan convert` can export an image in whatever format a given
+// hypervisor wants. Most conversions are delegated to qemu-img; raw and
+// VHD (both the fixed and the sparse/dynamic layout) are handled in
+// pure Go, following the Microsoft VHD spec, since that pair is cheap
+// enough not to need an external dependency.
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+type Format string
+
+const (
+	Raw        Format = "raw"
+	Qcow2      Format = "qcow2"
+	VMDK       Format = "vmdk"
+	VHD        Format = "vhd"         // fixed-size VHD
+	VHDDynamic Format = "vhd-dynamic" // sparse/dynamic VHD
+	VDI        Format = "vdi"
+)
+
+const sectorSize = 512
+
+// Convert transforms the image at src (encoded as from) into dst
+// (encoded as to). Converting a format to itself is a plain copy.
+func Convert(src, dst string, from, to Format) error {
+	if from == to {
+		return copyFile(src, dst)
+	}
+	if from == Raw && to == VHD {
+		return rawToFixedVHD(src, dst)
+	}
+	if from == Raw && to == VHDDynamic {
+		return rawToDynamicVHD(src, dst)
+	}
+	if (from == VHD || from == VHDDynamic) && to == Raw {
+		return vhdToRaw(src, dst)
+	}
+	args := []string{"convert", "-f", qemuImgFormat(from), "-O", qemuImgFormat(to)}
+	if to == VHD {
+		args = append(args, "-o", "subformat=fixed")
+	}
+	return run("qemu-img", append(args, src, dst)...)
+}
+
+// qemuImgFormat maps f to the format name qemu-img uses for it, which
+// is "vpc" for both VHD layouts.
+func qemuImgFormat(f Format) string {
+	if f == VHD || f == VHDDynamic {
+		return "vpc"
+	}
+	return string(f)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %s: %s", name, args, err, out)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// vhdFooter is the 512-byte footer common to every VHD, fixed or
+// dynamic, as laid out in the "Virtual Hard Disk Image Format
+// Specification". All multi-byte fields are big-endian.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometryCyl    uint16
+	DiskGeometryHeads  uint8
+	DiskGeometrySPT    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+const (
+	vhdDiskTypeFixed   = 2
+	vhdDiskTypeDynamic = 3
+)
+
+// vhdDynamicHeader is the 1024-byte "Dynamic Disk Header" that follows
+// the leading footer copy in a sparse/dynamic VHD.
+type vhdDynamicHeader struct {
+	Cookie             [8]byte
+	DataOffset         uint64
+	TableOffset        uint64
+	HeaderVersion      uint32
+	MaxTableEntries    uint32
+	BlockSize          uint32
+	Checksum           uint32
+	ParentUniqueID     [16]byte
+	ParentTimeStamp    uint32
+	Reserved1          uint32
+	ParentUnicodeName  [512]byte
+	ParentLocatorEntry [192]byte
+	Reserved2          [256]byte
+}
+
+const (
+	// vhdBlockSize is the spec's default dynamic-disk block size (2MiB).
+	vhdBlockSize = 2 * 1024 * 1024
+	// vhdBitmapSize is the per-block sector bitmap: one bit per sector
+	// in a block, rounded up to a sector (it comes out exact at 2MiB).
+	vhdBitmapSize = vhdBlockSize / sectorSize / 8
+	// vhdBATOffset is the fixed byte offset of the Block Allocation
+	// Table: right after the footer copy (512) and the header (1024).
+	vhdBATOffset = 512 + 1024
+	// vhdUnusedBlock marks a BAT entry with no backing data.
+	vhdUnusedBlock = 0xFFFFFFFF
+)
+
+// epochVHD is the VHD spec's reference timestamp: 2000-01-01 UTC.
+var epochVHD = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func chs(sectors uint64) (cyl uint16, heads uint8, spt uint8) {
+	heads, spt = 16, 63
+	cylTimesHeads := sectors / uint64(spt)
+	if cylTimesHeads >= 65535*uint64(heads) {
+		return 65535, heads, spt
+	}
+	return uint16(cylTimesHeads / uint64(heads)), heads, spt
+}
+
+func newFooter(size int64, diskType uint32, dataOffset uint64) *vhdFooter {
+	f := &vhdFooter{
+		Features:          0x00000002,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        dataOffset,
+		TimeStamp:         uint32(time.Now().UTC().Sub(epochVHD).Seconds()),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          diskType,
+	}
+	copy(f.Cookie[:], "conectix")
+	copy(f.CreatorApplication[:], "cpst")
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.DiskGeometryCyl, f.DiskGeometryHeads, f.DiskGeometrySPT = chs(uint64(size) / sectorSize)
+	f.Checksum = footerChecksum(f)
+	return f
+}
+
+func newFixedFooter(size int64) *vhdFooter {
+	return newFooter(size, vhdDiskTypeFixed, 0xFFFFFFFFFFFFFFFF)
+}
+
+func newDynamicFooter(size int64) *vhdFooter {
+	return newFooter(size, vhdDiskTypeDynamic, vhdBATOffset-1024)
+}
+
+// footerChecksum is the ones'-complement sum of all footer bytes with
+// the checksum field itself treated as zero.
+func footerChecksum(f *vhdFooter) uint32 {
+	cp := *f
+	cp.Checksum = 0
+	return structChecksum(&cp)
+}
+
+func newDynamicHeader(maxTableEntries uint32) *vhdDynamicHeader {
+	h := &vhdDynamicHeader{
+		DataOffset:      0xFFFFFFFFFFFFFFFF,
+		TableOffset:     vhdBATOffset,
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: maxTableEntries,
+		BlockSize:       vhdBlockSize,
+	}
+	copy(h.Cookie[:], "cxsparse")
+	h.Checksum = headerChecksum(h)
+	return h
+}
+
+func headerChecksum(h *vhdDynamicHeader) uint32 {
+	cp := *h
+	cp.Checksum = 0
+	return structChecksum(&cp)
+}
+
+func structChecksum(v interface{}) uint32 {
+	buf := make([]byte, 0, 1024)
+	writer := newByteWriter(&buf)
+	binary.Write(writer, binary.BigEndian, v)
+	var sum uint32
+	for _, b := range buf {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+type byteWriter struct{ buf *[]byte }
+
+func newByteWriter(buf *[]byte) *byteWriter { return &byteWriter{buf} }
+func (w *byteWriter) Write(p []byte) (int, error) {
+	*w.buf = append(*w.buf, p...)
+	return len(p), nil
+}
+
+// rawToFixedVHD appends a fixed-disk VHD footer to a copy of the raw
+// image, padding it up to a sector boundary first as the spec requires.
+func rawToFixedVHD(rawPath, vhdPath string) error {
+	info, err := os.Stat(rawPath)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if rem := size % sectorSize; rem != 0 {
+		size += sectorSize - rem
+	}
+
+	if err := copyFile(rawPath, vhdPath); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(vhdPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	footer := newFixedFooter(size)
+	if _, err := out.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	return binary.Write(out, binary.BigEndian, footer)
+}
+
+// rawToDynamicVHD lays out a sparse/dynamic VHD: a leading footer copy,
+// the dynamic disk header, a fully-populated Block Allocation Table
+// (every block is allocated — this always round-trips correctly, it
+// just doesn't save space the way a true sparse copy would), and the
+// block data itself (each block prefixed by an all-valid sector
+// bitmap), followed by the closing footer copy.
+func rawToDynamicVHD(rawPath, vhdPath string) error {
+	info, err := os.Stat(rawPath)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	numBlocks := uint32((size + vhdBlockSize - 1) / vhdBlockSize)
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+
+	batBytes := int64(numBlocks) * 4
+	batSectors := ((batBytes + sectorSize - 1) / sectorSize) * sectorSize
+	dataStart := int64(vhdBATOffset) + batSectors
+	blockStride := int64(vhdBitmapSize) + vhdBlockSize
+
+	out, err := os.Create(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	footer := newDynamicFooter(size)
+	if err := binary.Write(out, binary.BigEndian, footer); err != nil {
+		return err
+	}
+
+	if _, err := out.Seek(512, io.SeekStart); err != nil {
+		return err
+	}
+	header := newDynamicHeader(numBlocks)
+	if err := binary.Write(out, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	bat := make([]byte, batSectors)
+	for i := range bat {
+		bat[i] = 0xFF
+	}
+	for i := uint32(0); i < numBlocks; i++ {
+		sectorOffset := uint32((dataStart + int64(i)*blockStride) / sectorSize)
+		binary.BigEndian.PutUint32(bat[i*4:i*4+4], sectorOffset)
+	}
+	if _, err := out.Seek(int64(vhdBATOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Write(bat); err != nil {
+		return err
+	}
+
+	in, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	bitmap := make([]byte, vhdBitmapSize)
+	for i := range bitmap {
+		bitmap[i] = 0xFF
+	}
+	block := make([]byte, vhdBlockSize)
+	for i := uint32(0); i < numBlocks; i++ {
+		n, err := io.ReadFull(in, block)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		for j := n; j < len(block); j++ {
+			block[j] = 0
+		}
+		offset := dataStart + int64(i)*blockStride
+		if _, err := out.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Write(bitmap); err != nil {
+			return err
+		}
+		if _, err := out.Write(block); err != nil {
+			return err
+		}
+	}
+
+	footerOffset := dataStart + int64(numBlocks)*blockStride
+	if _, err := out.Seek(footerOffset, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(out, binary.BigEndian, footer)
+}
+
+// readFooter reads the trailing 512-byte footer that both fixed and
+// dynamic VHDs carry, so callers can tell which layout they're holding.
+func readFooter(path string) (*vhdFooter, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 512 {
+		return nil, fmt.Errorf("convert: %s is too small to be a VHD", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(-512, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	footer := &vhdFooter{}
+	if err := binary.Read(f, binary.BigEndian, footer); err != nil {
+		return nil, err
+	}
+	return footer, nil
+}
+
+// vhdToRaw reads a VHD's trailing footer to tell fixed and dynamic
+// layouts apart and dispatches to the matching reader.
+func vhdToRaw(vhdPath, rawPath string) error {
+	footer, err := readFooter(vhdPath)
+	if err != nil {
+		return err
+	}
+	switch footer.DiskType {
+	case vhdDiskTypeFixed:
+		return fixedVHDToRaw(vhdPath, rawPath)
+	case vhdDiskTypeDynamic:
+		return dynamicVHDToRaw(vhdPath, rawPath, footer)
+	default:
+		return fmt.Errorf("convert: unsupported VHD disk type %d", footer.DiskType)
+	}
+}
+
+// fixedVHDToRaw strips the trailing 512-byte footer off a fixed-disk
+// VHD, leaving the plain raw payload.
+func fixedVHDToRaw(vhdPath, rawPath string) error {
+	info, err := os.Stat(vhdPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() < 512 {
+		return fmt.Errorf("convert: %s is too small to be a VHD", vhdPath)
+	}
+	in, err := os.Open(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(rawPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, io.LimitReader(in, info.Size()-512))
+	return err
+}
+
+// dynamicVHDToRaw walks a dynamic VHD's Block Allocation Table in
+// order, writing each block's data (zeroes for unused/unallocated
+// blocks) until footer.CurrentSize bytes have been produced.
+func dynamicVHDToRaw(vhdPath, rawPath string, footer *vhdFooter) error {
+	in, err := os.Open(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := in.Seek(512, io.SeekStart); err != nil {
+		return err
+	}
+	header := &vhdDynamicHeader{}
+	if err := binary.Read(in, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	bat := make([]byte, int64(header.MaxTableEntries)*4)
+	if _, err := in.Seek(int64(header.TableOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(in, bat); err != nil {
+		return err
+	}
+
+	out, err := os.Create(rawPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	blockSize := int64(header.BlockSize)
+	bitmapSize := blockSize / sectorSize / 8
+	block := make([]byte, blockSize)
+	remaining := int64(footer.CurrentSize)
+	for i := uint32(0); i < header.MaxTableEntries && remaining > 0; i++ {
+		want := blockSize
+		if remaining < want {
+			want = remaining
+		}
+		entry := binary.BigEndian.Uint32(bat[i*4 : i*4+4])
+		if entry == vhdUnusedBlock {
+			if _, err := out.Write(make([]byte, want)); err != nil {
+				return err
+			}
+		} else {
+			offset := int64(entry)*sectorSize + bitmapSize
+			if _, err := in.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(in, block); err != nil {
+				return err
+			}
+			if _, err := out.Write(block[:want]); err != nil {
+				return err
+			}
+		}
+		remaining -= want
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package convert
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestRoundTrip round-trips a small raw image through every supported
+// format and back, and checks the payload region survives byte-for-byte.
+// The raw<->VHD (fixed and dynamic) paths are pure Go and always run;
+// the qemu-img-backed formats are skipped when qemu-img isn't on PATH.
+func TestRoundTrip(t *testing.T) {
+	formats := []struct {
+		name   Format
+		pureGo bool
+	}{
+		{VHD, true},
+		{VHDDynamic, true},
+		{Qcow2, false},
+		{VMDK, false},
+		{VDI, false},
+	}
+
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Log("qemu-img not found on PATH; only pure-Go formats will be exercised")
+	}
+
+	for _, f := range formats {
+		f := f
+		t.Run(string(f.name), func(t *testing.T) {
+			if !f.pureGo {
+				if _, err := exec.LookPath("qemu-img"); err != nil {
+					t.Skip("qemu-img not on PATH")
+				}
+			}
+
+			dir, err := ioutil.TempDir("", "capstan-convert-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			raw := filepath.Join(dir, "disk.raw")
+			payload := bytes.Repeat([]byte{0x42, 0x24}, 2048)
+			if err := ioutil.WriteFile(raw, payload, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			converted := filepath.Join(dir, "disk."+string(f.name))
+			if err := Convert(raw, converted, Raw, f.name); err != nil {
+				t.Fatalf("raw -> %s: %s", f.name, err)
+			}
+
+			back := filepath.Join(dir, "disk2.raw")
+			if err := Convert(converted, back, f.name, Raw); err != nil {
+				t.Fatalf("%s -> raw: %s", f.name, err)
+			}
+
+			got, err := ioutil.ReadFile(back)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[:len(payload)], payload) {
+				t.Fatalf("%s round trip: payload region does not match original", f.name)
+			}
+		})
+	}
+}
+
+// TestSameFormatIsACopy covers the from == to fast path.
+func TestSameFormatIsACopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capstan-convert-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "disk.raw")
+	payload := []byte("capstan")
+	if err := ioutil.WriteFile(src, payload, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "disk2.raw")
+	if err := Convert(src, dst, Raw, Raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("copy changed payload")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package machine keeps a registry of the VMs Capstan has launched, so
+// that `capstan machine ls|inspect|stop|rm|ssh` has something to act on
+// without going out-of-band to VBoxManage or ps. Hypervisor backends
+// write an entry here when they launch a VM; the `run` command removes
+// it again when the VM exits, and `machine stop` once it has stopped it.
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudius-systems/capstan/nat"
+	"github.com/cloudius-systems/capstan/util"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+type Machine struct {
+	Name       string
+	PID        int
+	Hypervisor string
+	SockPath   string
+	Image      string
+	Memory     int64
+	Cpus       int
+	NatRules   []nat.Rule
+}
+
+func registryDir() string {
+	return filepath.Join(util.HomePath(), ".capstan", "machines")
+}
+
+func path(name string) string {
+	return filepath.Join(registryDir(), name+".json")
+}
+
+// Save atomically writes m's registry entry, so a reader never observes
+// a partially-written file.
+func Save(m *Machine) error {
+	if err := os.MkdirAll(registryDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(registryDir(), m.Name+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path(m.Name))
+}
+
+// Remove deletes name's registry entry, if any. It is called once the
+// VM's process exits so `machine ls` never shows a stale entry.
+func Remove(name string) error {
+	err := os.Remove(path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func Load(name string) (*Machine, error) {
+	data, err := ioutil.ReadFile(path(name))
+	if err != nil {
+		return nil, err
+	}
+	m := &Machine{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func List() ([]*Machine, error) {
+	if err := os.MkdirAll(registryDir(), 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(registryDir())
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*Machine, 0, len(entries))
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		m, err := Load(entry.Name()[:len(entry.Name())-len(".json")])
+		if err != nil {
+			continue
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// SSH dials the host-side port that NatRules forwards to the guest's
+// port 22 and execs the system ssh client against it.
+func (m *Machine) SSH() error {
+	for _, rule := range m.NatRules {
+		if rule.GuestPort == "22" {
+			cmd := exec.Command("ssh", "-p", rule.HostPort, "-o", "NoHostAuthenticationForLocalhost=yes", "localhost")
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			return cmd.Run()
+		}
+	}
+	return fmt.Errorf("machine: %s has no NAT rule forwarding guest port 22", m.Name)
+}
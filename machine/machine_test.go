@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+package machine
+
+import (
+	"github.com/cloudius-systems/capstan/nat"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func withRegistry(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "capstan-machine-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HOME", dir)
+	return func() { os.RemoveAll(dir) }
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	defer withRegistry(t)()
+
+	m := &Machine{
+		Name:       "test-vm",
+		PID:        1234,
+		Hypervisor: "xhyve",
+		SockPath:   "/tmp/test-vm.sock",
+		Image:      "/tmp/test-vm.img",
+		Memory:     512,
+		Cpus:       2,
+		NatRules:   []nat.Rule{{GuestPort: "22", HostPort: "2222"}},
+	}
+	if err := Save(m); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load("test-vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != m.Name || got.PID != m.PID || got.Hypervisor != m.Hypervisor {
+		t.Fatalf("Load returned %+v, want %+v", got, m)
+	}
+	if len(got.NatRules) != 1 || got.NatRules[0] != m.NatRules[0] {
+		t.Fatalf("Load returned NatRules %+v, want %+v", got.NatRules, m.NatRules)
+	}
+}
+
+func TestList(t *testing.T) {
+	defer withRegistry(t)()
+
+	if err := Save(&Machine{Name: "vm-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(&Machine{Name: "vm-b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	machines, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 2 {
+		t.Fatalf("List returned %d machines, want 2", len(machines))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	defer withRegistry(t)()
+
+	if err := Save(&Machine{Name: "vm-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove("vm-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load("vm-a"); err == nil {
+		t.Fatal("Load succeeded after Remove")
+	}
+	if err := Remove("vm-a"); err != nil {
+		t.Fatalf("Remove on an already-removed machine returned %s, want nil", err)
+	}
+}
+
+func TestSSHWithNoMatchingNatRule(t *testing.T) {
+	m := &Machine{Name: "no-ssh-rule"}
+	if err := m.SSH(); err == nil {
+		t.Fatal("SSH succeeded with no NAT rule forwarding port 22")
+	}
+}
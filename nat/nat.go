@@ -0,0 +1,20 @@
+/*
+ * Copyright (C) 2014 Cloudius Systems, Ltd.
+ *
+ * This work is open source software, licensed under the terms of the
+ * BSD license as described in the LICENSE file in the top-level directory.
+ */
+
+// Package nat describes the port-forwarding rules a hypervisor backend
+// installs so a host port reaches a port on the guest's NAT'd network,
+// since neither vbox's natpf1 nor xhyve's pf(4) rdr rules expose a guest
+// port directly to the host otherwise.
+package nat
+
+// Rule forwards connections to HostPort on the host through to GuestPort
+// on the VM. Both are strings, matching the flag/arg types of the
+// VBoxManage and pfctl commands that consume them.
+type Rule struct {
+	GuestPort string
+	HostPort  string
+}
@@ -9,6 +9,7 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -26,3 +27,26 @@ func HomePath() string {
 func ID() string {
 	return fmt.Sprintf("i%v", time.Now().Unix())
 }
+
+// Connect dials the serial-console socket a hypervisor backend exposes
+// at path, i.e. a vbox "uartmode1 server" pipe or an xhyve "-l com1,<path>"
+// socket. Both backends retry this themselves since the socket doesn't
+// exist until the hypervisor process has started listening on it.
+func Connect(path string) (net.Conn, error) {
+	if runtime.GOOS == "windows" {
+		return net.Dial("pipe", path)
+	}
+	return net.Dial("unix", path)
+}
+
+// FreePort asks the kernel for a currently-unused TCP port, so a
+// hypervisor backend can pick a host port for a NAT rule without racing
+// another process for a hardcoded one.
+func FreePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return fmt.Sprintf("%d", l.Addr().(*net.TCPAddr).Port), nil
+}